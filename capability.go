@@ -0,0 +1,133 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// capabilityProbeTimeout bounds how long each individual capability probe below is allowed to take.
+const capabilityProbeTimeout = 2 * time.Second
+
+// dnsAddr returns the host:port pair used to dial ip on the standard DNS port, bracketing IPv6
+// addresses the way net.JoinHostPort does. A bare "ip+\":53\"" concatenation produces an invalid
+// address for IPv6 (e.g. "::1:53" instead of "[::1]:53"), so every dialer in this package builds its
+// address with net.JoinHostPort, either directly or through this helper.
+func dnsAddr(ip string) string {
+	return net.JoinHostPort(ip, "53")
+}
+
+// dnsHost formats ip for use as a URL host component, bracketing IPv6 addresses the same way
+// net.JoinHostPort does for a host:port pair.
+func dnsHost(ip string) string {
+	return strings.TrimSuffix(net.JoinHostPort(ip, "0"), ":0")
+}
+
+// DetectCapabilities actively probes server's IP address to fill in the capability fields that the CSV
+// never reports: whether it's an IPv6 address, whether it accepts a plain TCP connection on :53, whether it accepts a
+// DNS-over-TLS connection on :853, whether it answers an HTTPS GET against /dns-query, and the EDNS0
+// UDP payload size it advertises. Callers that only care about a subset of these can still call this
+// once per server before GetBestFromCountry(filter) is used to rank on the result.
+func DetectCapabilities(ctx context.Context, server *Nameserver) error {
+	server.IPv6 = strings.Contains(server.IPAddress, ":")
+	server.SupportsTCP = probeTCP(ctx, server.IPAddress)
+	server.SupportsDoT = probeDoT(ctx, server.IPAddress)
+	server.SupportsDoH = probeDoH(ctx, server.IPAddress)
+	server.EDNS0Size = probeEDNS0(ctx, server.IPAddress)
+
+	return nil
+}
+
+// probeTCP reports whether ip accepts a plain TCP connection on the standard DNS port.
+func probeTCP(ctx context.Context, ip string) bool {
+	dialer := net.Dialer{Timeout: capabilityProbeTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, "53"))
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// probeDoT reports whether ip accepts a TLS connection on the standard DNS-over-TLS port (RFC 7858).
+func probeDoT(ctx context.Context, ip string) bool {
+	dialer := net.Dialer{Timeout: capabilityProbeTimeout}
+
+	conn, err := tls.DialWithDialer(&dialer, "tcp", net.JoinHostPort(ip, "853"), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// probeDoH reports whether ip answers an HTTPS GET against the conventional DNS-over-HTTPS path
+// (RFC 8484).
+func probeDoH(ctx context.Context, ip string) bool {
+	client := http.Client{Timeout: capabilityProbeTimeout}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+dnsHost(ip)+"/dns-query", nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+
+	defer resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// probeEDNS0 sends an EDNS0-buffered UDP query and returns the UDP payload size the server advertised
+// in its response, or zero if the server didn't answer or didn't include an OPT record.
+func probeEDNS0(ctx context.Context, ip string) uint16 {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("example.com."), dns.TypeA)
+	msg.SetEdns0(4096, false)
+
+	client := dns.Client{Timeout: capabilityProbeTimeout, Net: "udp"}
+	resp, _, err := client.ExchangeContext(ctx, msg, dnsAddr(ip))
+
+	if err != nil || resp == nil {
+		return 0
+	}
+
+	if opt := resp.IsEdns0(); opt != nil {
+		return opt.UDPSize()
+	}
+
+	return 0
+}
@@ -0,0 +1,203 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// earthRadiusKm is the mean radius of the Earth in kilometers, used by the haversine distance below.
+const earthRadiusKm = 6371.0
+
+// GeoLocator resolves the approximate latitude/longitude of an IP address. It is consulted by
+// DumpToDatabaseWithGeoLocator to populate the nameservers table with coordinates so that GetNearest
+// can rank servers by great-circle distance instead of strict country-code equality.
+type GeoLocator interface {
+	Locate(ip string) (lat float64, lon float64, err error)
+}
+
+// MaxMindGeoLocator implements GeoLocator on top of a MaxMind GeoLite2 City database, opened with
+// github.com/oschwald/geoip2-golang.
+type MaxMindGeoLocator struct {
+	DB *geoip2.Reader
+}
+
+// NewMaxMindGeoLocator opens the GeoLite2 City database at filename.
+func NewMaxMindGeoLocator(filename string) (*MaxMindGeoLocator, error) {
+	db, err := geoip2.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaxMindGeoLocator{DB: db}, nil
+}
+
+// Locate resolves ip to a latitude/longitude pair using the underlying GeoLite2 City database.
+func (m *MaxMindGeoLocator) Locate(ip string) (float64, float64, error) {
+	parsed := net.ParseIP(ip)
+
+	if parsed == nil {
+		return 0, 0, fmt.Errorf("geo: %q is not a valid IP address", ip)
+	}
+
+	record, err := m.DB.City(parsed)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return record.Location.Latitude, record.Location.Longitude, nil
+}
+
+// ensureGeoColumns adds the latitude/longitude columns to the nameservers table if they are not
+// already present. As with ensureProbeColumns, it's safe to ignore the error SQLite raises when a
+// column already exists.
+func ensureGeoColumns(db *sql.DB) error {
+	columns := []string{
+		`ALTER TABLE nameservers ADD COLUMN latitude FLOAT NULL`,
+		`ALTER TABLE nameservers ADD COLUMN longitude FLOAT NULL`,
+	}
+
+	for _, column := range columns {
+		db.Exec(column)
+	}
+
+	return nil
+}
+
+// DumpToDatabaseWithGeoLocator behaves exactly like DumpToDatabase but additionally resolves every
+// server's IP address to a latitude/longitude pair using locator and persists it into the nameservers
+// table, so that GetNearest and GetNearestFromClientIP have coordinates to rank against.
+func DumpToDatabaseWithGeoLocator(db *sql.DB, servers []*Nameserver, locator GeoLocator) (int64, error) {
+	total, err := DumpToDatabase(db, servers)
+
+	if err != nil {
+		return total, err
+	}
+
+	if err := ensureGeoColumns(db); err != nil {
+		return total, err
+	}
+
+	stmt, err := db.Prepare(`UPDATE nameservers SET latitude = ?, longitude = ? WHERE ip = ?`)
+
+	if err != nil {
+		return total, err
+	}
+
+	defer stmt.Close()
+
+	for _, server := range servers {
+		lat, lon, locateErr := locator.Locate(server.IPAddress)
+
+		if locateErr != nil {
+			continue
+		}
+
+		stmt.Exec(lat, lon, server.IPAddress)
+	}
+
+	return total, nil
+}
+
+// haversineKm returns the great-circle distance, in kilometers, between two latitude/longitude pairs.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return earthRadiusKm * c
+}
+
+// nearbyServer pairs a Nameserver with its computed distance, used while sorting GetNearest's results.
+type nearbyServer struct {
+	server   *Nameserver
+	distance float64
+}
+
+// GetNearest returns the k closest reliable nameservers to the given coordinates, ranked by
+// great-circle distance rather than a strict country-code match. This makes neighbouring-country
+// resolvers usable for clients whose own country has few or unreliable servers.
+func (p *PublicDNS) GetNearest(lat float64, lon float64, k int) ([]*Nameserver, error) {
+	rows, err := p.DB.Query("SELECT ip, country, city, latitude, longitude FROM nameservers " +
+		"WHERE latitude IS NOT NULL AND longitude IS NOT NULL AND reliability = 1 AND retired_at IS NULL")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var candidates []nearbyServer
+
+	for rows.Next() {
+		info := &Nameserver{}
+		var serverLat, serverLon float64
+
+		if err := rows.Scan(&info.IPAddress, &info.Country, &info.City, &serverLat, &serverLon); err != nil {
+			continue
+		}
+
+		candidates = append(candidates, nearbyServer{
+			server:   info,
+			distance: haversineKm(lat, lon, serverLat, serverLon),
+		})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+
+	nearest := make([]*Nameserver, 0, k)
+	for i := 0; i < k; i++ {
+		nearest = append(nearest, candidates[i].server)
+	}
+
+	return nearest, nil
+}
+
+// GetNearestFromClientIP geolocates ip using locator and returns the k closest reliable nameservers to
+// that location, so callers only need the caller's IP address rather than its coordinates.
+func (p *PublicDNS) GetNearestFromClientIP(ip net.IP, k int, locator GeoLocator) ([]*Nameserver, error) {
+	lat, lon, err := locator.Locate(ip.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p.GetNearest(lat, lon, k)
+}
@@ -0,0 +1,335 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ProbeOptions configures how PublicDNS.Probe exercises the nameserver set with live DNS queries instead
+// of trusting the reliability value reported by the public-dns.info CSV.
+type ProbeOptions struct {
+	// QName is the domain name queried against every nameserver, e.g. "example.com."
+	QName string
+
+	// QType is the DNS record type that is requested, e.g. dns.TypeA
+	QType uint16
+
+	// Timeout is the per-query timeout. A query that exceeds this is counted as a loss.
+	Timeout time.Duration
+
+	// Repetitions is how many times each nameserver is queried. The median RTT of the successful
+	// attempts is the value that gets persisted.
+	Repetitions int
+
+	// Concurrency is the amount of nameservers that the worker pool probes at the same time.
+	Concurrency int
+
+	// WeightByReliability makes the persisted score blend the CSV-reported reliability with the
+	// observed latency as reliability * (1/latency) instead of using the latency alone.
+	WeightByReliability bool
+}
+
+// probeResult holds the outcome of probing a single nameserver.
+type probeResult struct {
+	ip         string
+	medianRTT  time.Duration
+	packetLoss float64
+	truncated  bool
+	recursion  bool
+	ad         bool
+}
+
+// Probe iterates the nameservers currently stored in the database and issues real DNS queries against
+// each of them using github.com/miekg/dns (UDP first, falling back to TCP when the response comes back
+// truncated, the same fallback the Go standard library exercises in its own DNS client tests). The
+// median RTT, packet loss (as a fraction from 0 to 1), TC/RA flags and the observed AD bit are persisted back into the
+// nameservers table so that GetFastestFromCountry and GetFastestFromCountries can rank on real,
+// locally-observed behaviour.
+func (p *PublicDNS) Probe(ctx context.Context, opts ProbeOptions) error {
+	if opts.QName == "" {
+		opts.QName = "example.com."
+	}
+
+	if opts.QType == 0 {
+		opts.QType = dns.TypeA
+	}
+
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	if opts.Repetitions <= 0 {
+		opts.Repetitions = 3
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 16
+	}
+
+	if err := ensureProbeColumns(p.DB); err != nil {
+		return err
+	}
+
+	rows, err := p.DB.Query("SELECT ip, reliability FROM nameservers")
+
+	if err != nil {
+		return err
+	}
+
+	type target struct {
+		ip          string
+		reliability float64
+	}
+
+	var targets []target
+	for rows.Next() {
+		var t target
+		rows.Scan(&t.ip, &t.reliability)
+		targets = append(targets, t)
+	}
+	rows.Close()
+
+	type scored struct {
+		target
+		probeResult
+	}
+
+	jobs := make(chan target)
+	results := make(chan scored)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				results <- scored{t, probeNameserver(ctx, t.ip, opts)}
+			}
+		}()
+	}
+
+	go func() {
+		for _, t := range targets {
+			jobs <- t
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	stmt, err := p.DB.Prepare(`UPDATE nameservers SET latency_ms = ?, packet_loss = ?, tc_flag = ?,
+		ra_flag = ?, dnssec_ad = ?, score = ? WHERE ip = ?`)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	for r := range results {
+		score := calculateScore(r.reliability, r.medianRTT, opts.WeightByReliability)
+
+		// A server with 100% packet loss never produced an RTT, so medianRTT is a meaningless zero -
+		// persist NULL instead of 0 or it would outrank every server that actually answered.
+		var latency interface{}
+		if r.packetLoss < 1 {
+			latency = r.medianRTT.Milliseconds()
+		}
+
+		stmt.Exec(latency, r.packetLoss, r.truncated, r.recursion, r.ad, score, r.target.ip)
+	}
+
+	return nil
+}
+
+// probeNameserver sends opts.Repetitions queries to a single nameserver and summarizes the result into
+// a probeResult. Individual query failures are treated as packet loss rather than a hard error so that
+// one unreachable server does not abort the whole Probe run.
+func probeNameserver(ctx context.Context, ip string, opts ProbeOptions) probeResult {
+	result := probeResult{ip: ip}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(opts.QName), opts.QType)
+	msg.RecursionDesired = true
+
+	udp := &dns.Client{Timeout: opts.Timeout, Net: "udp"}
+	tcp := &dns.Client{Timeout: opts.Timeout, Net: "tcp"}
+
+	var rtts []time.Duration
+
+	for i := 0; i < opts.Repetitions; i++ {
+		resp, rtt, err := udp.ExchangeContext(ctx, msg, dnsAddr(ip))
+
+		if err != nil {
+			continue
+		}
+
+		if resp.Truncated {
+			result.truncated = true
+			resp, rtt, err = tcp.ExchangeContext(ctx, msg, dnsAddr(ip))
+
+			if err != nil {
+				continue
+			}
+		}
+
+		result.recursion = resp.RecursionAvailable
+		result.ad = resp.AuthenticatedData
+		rtts = append(rtts, rtt)
+	}
+
+	result.packetLoss = 1 - float64(len(rtts))/float64(opts.Repetitions)
+	result.medianRTT = medianDuration(rtts)
+
+	return result
+}
+
+// medianDuration returns the median of the given durations, or zero when the slice is empty.
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+
+	return sorted[mid]
+}
+
+// calculateScore combines the CSV-reported reliability with the observed latency as
+// reliability * (1/latency) when weighted is true, or just 1/latency otherwise, so that callers can
+// blend the upstream metric with locally observed performance.
+func calculateScore(reliability float64, rtt time.Duration, weighted bool) float64 {
+	if rtt <= 0 {
+		return 0
+	}
+
+	inverseLatency := 1 / rtt.Seconds()
+
+	if !weighted {
+		return inverseLatency
+	}
+
+	return reliability * inverseLatency
+}
+
+// ensureProbeColumns adds the columns populated by Probe to the nameservers table if they are not
+// already present. SQLite has no "ADD COLUMN IF NOT EXISTS" so the error raised when a column already
+// exists is ignored.
+func ensureProbeColumns(db *sql.DB) error {
+	columns := []string{
+		`ALTER TABLE nameservers ADD COLUMN latency_ms INTEGER NULL`,
+		`ALTER TABLE nameservers ADD COLUMN packet_loss FLOAT NULL`,
+		`ALTER TABLE nameservers ADD COLUMN tc_flag TINYINT NULL`,
+		`ALTER TABLE nameservers ADD COLUMN ra_flag TINYINT NULL`,
+		`ALTER TABLE nameservers ADD COLUMN dnssec_ad TINYINT NULL`,
+		`ALTER TABLE nameservers ADD COLUMN score FLOAT NULL`,
+	}
+
+	for _, column := range columns {
+		db.Exec(column)
+	}
+
+	return nil
+}
+
+// GetFastestFromCountry obtains the nameserver with the lowest observed median RTT for a specific
+// country, as measured by Probe, instead of relying on the static reliability value reported by
+// public-dns.info.
+func (p *PublicDNS) GetFastestFromCountry(country string) (*Nameserver, error) {
+	result := p.DB.QueryRow("SELECT ip, country, city FROM nameservers "+
+		"WHERE country = ? AND latency_ms IS NOT NULL AND retired_at IS NULL ORDER BY latency_ms ASC LIMIT 1", country)
+
+	info := &Nameserver{}
+	err := result.Scan(&info.IPAddress, &info.Country, &info.City)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// GetFastestFromCountries takes a list of countries (two-letter ISO 3166-1 alpha-2 code) and obtains the
+// fastest probed server for each of the requested countries, mirroring GetBestFromCountries but ranking
+// on the measured latency rather than the CSV reliability value.
+//
+// Unlike GetBestFromCountries' "GROUP BY" trick - which only happens to work there because every
+// candidate ties at reliability = 1 - picking the fastest server per country has to pin the row with an
+// explicit MIN(latency_ms), since SQLite does not guarantee which row a GROUP BY without an aggregate
+// returns.
+func (p *PublicDNS) GetFastestFromCountries(countries []interface{}) ([]*Nameserver, error) {
+	placeholders := "?" + strings.Repeat(", ?", len(countries)-1)
+
+	query := "SELECT n.ip, n.country, n.city " +
+		"FROM nameservers AS n " +
+		"INNER JOIN (" +
+		"SELECT country, MIN(latency_ms) AS min_latency FROM nameservers " +
+		"WHERE country IN (" + placeholders + ") AND latency_ms IS NOT NULL AND retired_at IS NULL " +
+		"GROUP BY country" +
+		") AS fastest ON fastest.country = n.country AND fastest.min_latency = n.latency_ms " +
+		"WHERE n.country IN (" + placeholders + ") AND n.retired_at IS NULL"
+
+	stmt, err := p.DB.Prepare(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stmt.Close()
+
+	args := append(append([]interface{}{}, countries...), countries...)
+	result, err := stmt.Query(args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	var dnsinfo []*Nameserver
+
+	for result.Next() {
+		info := &Nameserver{}
+		result.Scan(&info.IPAddress, &info.Country, &info.City)
+		dnsinfo = append(dnsinfo, info)
+	}
+
+	return dnsinfo, nil
+}
@@ -0,0 +1,58 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"testing"
+	"time"
+)
+
+func TestMedianDuration(t *testing.T) {
+	if got := medianDuration(nil); got != 0 {
+		t.Errorf("Empty input should return zero but returned -- %s --", got)
+	}
+
+	odd := []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}
+	if got := medianDuration(odd); got != 20*time.Millisecond {
+		t.Errorf("Median of an odd-length slice should be the middle value but returned -- %s --", got)
+	}
+
+	even := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	if got := medianDuration(even); got != 25*time.Millisecond {
+		t.Errorf("Median of an even-length slice should average the two middle values but returned -- %s --", got)
+	}
+}
+
+func TestCalculateScore(t *testing.T) {
+	if got := calculateScore(1, 0, false); got != 0 {
+		t.Errorf("A non-positive RTT should score zero but returned -- %f --", got)
+	}
+
+	if got := calculateScore(0.5, time.Second, false); got != 1 {
+		t.Errorf("Unweighted score should be 1/latency regardless of reliability but returned -- %f --", got)
+	}
+
+	if got := calculateScore(0.5, time.Second, true); got != 0.5 {
+		t.Errorf("Weighted score should be reliability * 1/latency but returned -- %f --", got)
+	}
+}
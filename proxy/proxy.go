@@ -0,0 +1,448 @@
+// Package proxy implements a local DNS proxy that accepts plain DNS queries over UDP and TCP and
+// forwards them over plain DNS, DNS-over-TLS or DNS-over-HTTPS to nameservers selected from the
+// PublicDNS dataset, in the same
+// dns-to-https / dns-to-dns topology popularized by dnss.
+package proxy
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	publicdns "github.com/rvelhote/go-public-dns"
+)
+
+// Transport identifies the protocol used to reach an upstream nameserver.
+type Transport int
+
+const (
+	// TransportUDP speaks plain DNS over UDP, falling back to TCP on truncation.
+	TransportUDP Transport = iota
+
+	// TransportTCP speaks plain DNS over TCP.
+	TransportTCP
+
+	// TransportDoT speaks DNS-over-TLS, as described in RFC 7858.
+	TransportDoT
+
+	// TransportDoH speaks DNS-over-HTTPS, as described in RFC 8484.
+	TransportDoH
+)
+
+// Upstream describes a single upstream nameserver and how to reach it. Address is a host:port pair for
+// TransportUDP/TransportTCP/TransportDoT, or the full "https://host/dns-query" endpoint for TransportDoH.
+type Upstream struct {
+	Address   string
+	Transport Transport
+}
+
+// Selector picks the upstream(s) that a query should be forwarded to. Select returns up to k candidates
+// ordered from most to least preferred so that Forwarder can hedge across the top ones.
+type Selector interface {
+	Select(k int) ([]Upstream, error)
+}
+
+// RoundRobinSelector cycles through a fixed list of upstreams, distributing load evenly across them.
+type RoundRobinSelector struct {
+	mu        sync.Mutex
+	upstreams []Upstream
+	next      int
+}
+
+// NewRoundRobinSelector creates a RoundRobinSelector over the given upstreams.
+func NewRoundRobinSelector(upstreams []Upstream) *RoundRobinSelector {
+	return &RoundRobinSelector{upstreams: upstreams}
+}
+
+// Select returns up to k upstreams starting from the selector's current round-robin position.
+func (s *RoundRobinSelector) Select(k int) ([]Upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.upstreams) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+
+	if k > len(s.upstreams) {
+		k = len(s.upstreams)
+	}
+
+	selected := make([]Upstream, 0, k)
+	for i := 0; i < k; i++ {
+		selected = append(selected, s.upstreams[(s.next+i)%len(s.upstreams)])
+	}
+
+	s.next = (s.next + 1) % len(s.upstreams)
+
+	return selected, nil
+}
+
+// Replace atomically swaps the upstream list, used when the pool is refreshed from PublicDNS.
+func (s *RoundRobinSelector) Replace(upstreams []Upstream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstreams = upstreams
+	s.next = 0
+}
+
+// publicDNSSelectorPoolSize is how many ranked servers PublicDNSSelector.Refresh keeps around for
+// Country, giving Forwarder enough candidates to hedge across and RoundRobinSelector-style load
+// balancing something to balance over.
+const publicDNSSelectorPoolSize = 8
+
+// PublicDNSSelector picks upstreams from the PublicDNS SQLite dataset, re-reading the best-ranked
+// servers for Country every time the pool is refreshed so that re-scored reliability is reflected.
+type PublicDNSSelector struct {
+	DB      *publicdns.PublicDNS
+	Country string
+
+	mu        sync.RWMutex
+	upstreams []Upstream
+	next      int
+}
+
+// NewPublicDNSSelector creates a PublicDNSSelector and performs an initial load of upstreams for country.
+func NewPublicDNSSelector(db *publicdns.PublicDNS, country string) (*PublicDNSSelector, error) {
+	selector := &PublicDNSSelector{DB: db, Country: country}
+
+	if err := selector.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return selector, nil
+}
+
+// Refresh re-reads the publicDNSSelectorPoolSize best-ranked nameservers for Country from the PublicDNS
+// dataset. It is meant to be called periodically so the proxy picks up freshly re-scored servers.
+func (s *PublicDNSSelector) Refresh() error {
+	servers, err := s.DB.GetTopFromCountry(s.Country, publicDNSSelectorPoolSize, publicdns.Filter{})
+
+	if err != nil {
+		return err
+	}
+
+	if len(servers) == 0 {
+		return fmt.Errorf("no upstreams available for country %q", s.Country)
+	}
+
+	upstreams := make([]Upstream, 0, len(servers))
+	for _, server := range servers {
+		upstreams = append(upstreams, Upstream{Address: net.JoinHostPort(server.IPAddress, "53"), Transport: TransportUDP})
+	}
+
+	s.mu.Lock()
+	s.upstreams = upstreams
+	s.next = 0
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Select returns up to k upstreams from the ranked pool for Country, rotating the starting point on
+// every call the same way RoundRobinSelector does, so that repeated calls balance load across the whole
+// pool instead of always hedging across the same top servers.
+func (s *PublicDNSSelector) Select(k int) ([]Upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.upstreams) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+
+	if k > len(s.upstreams) {
+		k = len(s.upstreams)
+	}
+
+	selected := make([]Upstream, 0, k)
+	for i := 0; i < k; i++ {
+		selected = append(selected, s.upstreams[(s.next+i)%len(s.upstreams)])
+	}
+
+	s.next = (s.next + 1) % len(s.upstreams)
+
+	return selected, nil
+}
+
+// RefreshPool periodically reloads servers from url into the PublicDNS database and asks selector to
+// refresh its cached upstream list, keeping the proxy's pool aligned with the latest re-scored data.
+// It blocks until ctx is cancelled.
+func RefreshPool(ctx context.Context, db *publicdns.PublicDNS, selector *PublicDNSSelector, url string, filename string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			servers, err := publicdns.LoadFromURL(db.DB, url, filename)
+			if err != nil {
+				// ErrNotModified just means the upstream CSV hasn't changed since the last fetch.
+				continue
+			}
+
+			publicdns.DumpToDatabase(db.DB, servers)
+			selector.Refresh()
+		}
+	}
+}
+
+// cacheEntry is a single cached DNS response, valid until expires.
+type cacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// answerCache is a minimal positive/negative response cache keyed on (qname, qtype, qclass), honoring
+// the TTL of the cached answer (or a short negative TTL for NXDOMAIN/SERVFAIL responses).
+type answerCache struct {
+	mu          sync.RWMutex
+	entries     map[string]cacheEntry
+	negativeTTL time.Duration
+}
+
+func newAnswerCache(negativeTTL time.Duration) *answerCache {
+	return &answerCache{entries: make(map[string]cacheEntry), negativeTTL: negativeTTL}
+}
+
+func cacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s|%d|%d", q.Name, q.Qtype, q.Qclass)
+}
+
+func (c *answerCache) get(q dns.Question) (*dns.Msg, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[cacheKey(q)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.msg.Copy(), true
+}
+
+func (c *answerCache) set(q dns.Question, msg *dns.Msg) {
+	ttl := c.negativeTTL
+
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		ttl = time.Duration(msg.Answer[0].Header().Ttl) * time.Second
+	}
+
+	c.mu.Lock()
+	c.entries[cacheKey(q)] = cacheEntry{msg: msg.Copy(), expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+// Forwarder forwards incoming DNS queries to upstreams chosen by Selector. It caches answers and, when
+// HedgeCount is greater than one, fires the query at the top HedgeCount candidates concurrently and
+// returns whichever valid response comes back first.
+type Forwarder struct {
+	Selector    Selector
+	HedgeCount  int
+	Timeout     time.Duration
+	NegativeTTL time.Duration
+
+	cache *answerCache
+}
+
+// NewForwarder creates a Forwarder that forwards queries via selector, hedging across hedgeCount
+// upstreams at a time.
+func NewForwarder(selector Selector, hedgeCount int) *Forwarder {
+	if hedgeCount < 1 {
+		hedgeCount = 1
+	}
+
+	return &Forwarder{
+		Selector:    selector,
+		HedgeCount:  hedgeCount,
+		Timeout:     2 * time.Second,
+		NegativeTTL: 30 * time.Second,
+		cache:       newAnswerCache(30 * time.Second),
+	}
+}
+
+// ServeDNS implements dns.Handler, making Forwarder usable directly as a miekg/dns server handler.
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp, err := f.Forward(context.Background(), r)
+
+	if err != nil || resp == nil {
+		failure := new(dns.Msg)
+		failure.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(failure)
+		return
+	}
+
+	w.WriteMsg(resp)
+}
+
+// Forward resolves r, serving from cache when possible and otherwise hedging the query across the
+// top-K upstreams returned by the Selector.
+func (f *Forwarder) Forward(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) == 1 {
+		if cached, ok := f.cache.get(r.Question[0]); ok {
+			cached.Id = r.Id
+			return cached, nil
+		}
+	}
+
+	upstreams, err := f.Selector.Select(f.HedgeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+
+	type race struct {
+		msg *dns.Msg
+		err error
+	}
+
+	results := make(chan race, len(upstreams))
+
+	for _, upstream := range upstreams {
+		upstream := upstream
+		go func() {
+			msg, err := exchange(ctx, upstream, r)
+			results <- race{msg, err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(upstreams); i++ {
+		res := <-results
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+
+		if len(r.Question) == 1 {
+			f.cache.set(r.Question[0], res.msg)
+		}
+
+		return res.msg, nil
+	}
+
+	return nil, lastErr
+}
+
+// exchange sends r to upstream using the transport it was configured with and returns the response.
+func exchange(ctx context.Context, upstream Upstream, r *dns.Msg) (*dns.Msg, error) {
+	switch upstream.Transport {
+	case TransportUDP:
+		client := &dns.Client{Net: "udp"}
+		resp, _, err := client.ExchangeContext(ctx, r, upstream.Address)
+		if err == nil && resp != nil && resp.Truncated {
+			client = &dns.Client{Net: "tcp"}
+			resp, _, err = client.ExchangeContext(ctx, r, upstream.Address)
+		}
+		return resp, err
+	case TransportTCP:
+		client := &dns.Client{Net: "tcp"}
+		resp, _, err := client.ExchangeContext(ctx, r, upstream.Address)
+		return resp, err
+	case TransportDoT:
+		client := &dns.Client{Net: "tcp-tls"}
+		resp, _, err := client.ExchangeContext(ctx, r, upstream.Address)
+		return resp, err
+	case TransportDoH:
+		return exchangeDoH(ctx, upstream.Address, r)
+	default:
+		return nil, fmt.Errorf("unsupported transport %d", upstream.Transport)
+	}
+}
+
+// exchangeDoH sends r as a DNS-over-HTTPS request per RFC 8484, using the "application/dns-message"
+// wire format against the given endpoint.
+func exchangeDoH(ctx context.Context, endpoint string, r *dns.Msg) (*dns.Msg, error) {
+	packed, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Server listens for incoming DNS queries on UDP and TCP and forwards them via Forwarder. It mirrors
+// the dns-to-https / dns-to-dns topology used by dnss: clients always speak plain DNS to Server, which
+// then talks whatever protocol the selected upstream requires.
+type Server struct {
+	Addr      string
+	Forwarder *Forwarder
+}
+
+// NewServer creates a Server listening on addr that forwards via forwarder.
+func NewServer(addr string, forwarder *Forwarder) *Server {
+	return &Server{Addr: addr, Forwarder: forwarder}
+}
+
+// ListenAndServe starts the UDP and TCP listeners and blocks until either one returns an error.
+func (s *Server) ListenAndServe() error {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.Forwarder.ServeDNS)
+
+	udpServer := &dns.Server{Addr: s.Addr, Net: "udp", Handler: mux}
+	tcpServer := &dns.Server{Addr: s.Addr, Net: "tcp", Handler: mux}
+
+	errc := make(chan error, 2)
+	go func() { errc <- udpServer.ListenAndServe() }()
+	go func() { errc <- tcpServer.ListenAndServe() }()
+
+	return <-errc
+}
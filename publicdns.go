@@ -71,6 +71,28 @@ type Nameserver struct {
 
 	// CreatedAt is a timestamp to indicate when the server was inserted in the database
 	CreatedAt time.Time `csv:"created_at"`
+
+	// IPv6 indicates whether IPAddress is an IPv6 address rather than an IPv4 one. It is derived from
+	// IPAddress rather than read from the CSV, which only ever publishes the address itself.
+	IPv6 bool `csv:"-"`
+
+	// Transport identifies which query transport this row's capability columns describe, e.g. "udp",
+	// "tcp", "dot" or "doh". Together with IPAddress it forms the row's composite primary key, since
+	// the same server can support more than one transport.
+	Transport string `csv:"-"`
+
+	// SupportsTCP indicates whether the server accepted a plain TCP connection on port 53.
+	SupportsTCP bool `csv:"-"`
+
+	// SupportsDoT indicates whether the server accepted a DNS-over-TLS connection on port 853.
+	SupportsDoT bool `csv:"-"`
+
+	// SupportsDoH indicates whether the server answered an HTTPS GET against /dns-query.
+	SupportsDoH bool `csv:"-"`
+
+	// EDNS0Size is the UDP payload size the server advertised in its EDNS0 OPT record, or zero if it
+	// was never probed.
+	EDNS0Size uint16 `csv:"-"`
 }
 
 // LoadFromFile takes a filename (assumed to be a CSV) and loads the server data contained in that file.
@@ -90,156 +112,98 @@ func LoadFromFile(filename string) ([]*Nameserver, error) {
 		return nil, err
 	}
 
+	// The CSV only ever describes the plain DNS transport; IPv6-ness is derived from the address
+	// itself rather than published as its own column.
+	for _, server := range servers {
+		server.Transport = "udp"
+		server.IPv6 = strings.Contains(server.IPAddress, ":")
+	}
+
 	return servers, nil
 }
 
 // LoadFromURL takes a URL with a CSV file, downloads the file and attempts to load the file contents using the
 // previously refered LoadFromFile. A filename called nameservers.temp.csv will be created.
-func LoadFromURL(url string, filename string) ([]*Nameserver, error) {
-	out, err := os.Create(filename)
-
-	if err != nil {
+//
+// The request is conditional: the ETag/Last-Modified from the previous successful fetch of this exact
+// url are read from the sync_metadata table (created by Migrator) and sent as If-None-Match/
+// If-Modified-Since. If the upstream answers with HTTP 304, LoadFromURL returns ErrNotModified and
+// nothing is downloaded, making periodic refreshes cheap.
+func LoadFromURL(db *sql.DB, url string, filename string) ([]*Nameserver, error) {
+	if err := NewMigrator(db).Migrate(); err != nil {
 		return nil, err
 	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-	written, err := io.Copy(out, resp.Body)
+	etag, lastModified := readSyncMetadata(db, url)
 
-	if err != nil {
-		return nil, err
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
 
-	if written == 0 {
-		return nil, errors.New("No bytes written")
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
 	}
 
-	err = out.Sync()
+	resp, err := http.DefaultClient.Do(req)
+
 	if err != nil {
 		return nil, err
 	}
 
-	out.Close()
-
-	return LoadFromFile(out.Name())
-}
-
-// DumpToDatabase dumps a complete server dataset into the selected database instance. It will create the database
-// if it does not exist and insert all records present in the 'servers' variable. This function will insert all records
-// in a single transaction. The test data indicates about 40000 records but the performance seems perfectly fine. Also
-// consider that the table will be dropped.
-//
-// The database schema amounts to the same fields as the CSV value that you can find at public-dns.info.
-// - IP (the ipv4 address of the server)
-// - Name (the hostname of the server if the server has a hostname)
-// - Country (two-letter ISO 3166-1 alpha-2 code. probably an IP location lookup by public-dns.info)
-// - City (the city name that the server is hosted on. probably an IP location lookup by public-dns.info)
-// - Version (the software version of the dns daemon that the server is using)
-// - Error (the error that the server returned. probably will be empty if you are using the valid nameserver dataset)
-// - DNSSec (boolean to indicate if the server supports DNSSec or not)
-// - Reliability (a reliability value - normalized from 0.0 - 1.0 - to indicate how stable the server is)
-// - CheckedAt (a timestamp to indicate the date that the server was last checked)
-// - CreatedAt (a timestamp to indicate when the server was inserted in the database)
-//
-// TODO Create an index for Country, Reliability and IP
-// TODO Fix the schema and the data types of each field to be something meaningful instead of 100% varchar
-func DumpToDatabase(db *sql.DB, servers []*Nameserver) (int64, error) {
-	var total int64
-	var query string
-	var fields []string
-
-	// It's safe to ignore the execution error that my occur.
-	// If there is an problem with the deletion it will be thrown in the table creation query
-	db.Exec(`DROP TABLE 'nameservers'`)
-
-	fields = []string{
-		`'ip' VARCHAR(45) PRIMARY KEY`,
-		`'name' VARCHAR(64) NULL`,
-		`'country' VARCHAR(2) NULL`,
-		`'city' VARCHAR(64) NULL`,
-		`'version' VARCHAR(16) NULL`,
-		`'error' VARCHAR(256) NULL`,
-		`'dnssec' TINYINT NULL`,
-		`'reliability' FLOAT NULL`,
-		`'checked_at' DATETIME NULL`,
-		`'created_at' DATETIME NULL`,
-	}
-
-	query = `CREATE TABLE IF NOT EXISTS 'nameservers' (` + strings.Join(fields, ",") + `);`
-	_, errCreateTable := db.Exec(query)
-
-	if errCreateTable != nil {
-		return total, errCreateTable
-	}
+	defer resp.Body.Close()
 
-	indexes := []string{
-		"CREATE INDEX nameservers_country_index ON nameservers(country);",
-		"CREATE INDEX nameservers_country_reliability_index ON nameservers(country,reliability);",
-		"CREATE INDEX nameservers_reliability_index ON nameservers(reliability);",
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
 	}
 
-	_, errCreateIndexes := db.Exec(strings.Join(indexes, ""))
+	out, err := os.Create(filename)
 
-	if errCreateIndexes != nil {
-		return total, errCreateIndexes
+	if err != nil {
+		return nil, err
 	}
 
-	tx, err := db.Begin()
+	written, err := io.Copy(out, resp.Body)
 
 	if err != nil {
-		return total, err
+		return nil, err
 	}
 
-	fields = []string{
-		"ip",
-		"name",
-		"country",
-		"city",
-		"version",
-		"error",
-		"dnssec",
-		"reliability",
-		"checked_at",
-		"created_at",
+	if written == 0 {
+		return nil, errors.New("No bytes written")
 	}
 
-	query = "INSERT INTO nameservers(" + strings.Join(fields, ",") + ") VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	stmt, prepareErr := tx.Prepare(query)
-
-	if prepareErr != nil {
-		return total, prepareErr
+	err = out.Sync()
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO Should we check for an error while creating the statement or just count on the transaction to fail?
-	for _, client := range servers {
-		r, _ := stmt.Exec(
-			client.IPAddress,
-			client.Name,
-			client.Country,
-			client.City,
-			client.Version,
-			client.Error,
-			client.DNSSec,
-			client.Reliability,
-			client.CheckedAt,
-			client.CreatedAt,
-		)
+	out.Close()
 
-		n, _ := r.RowsAffected()
-		total = total + n
-	}
+	writeSyncMetadata(db, url, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
 
-	if txErr := tx.Commit(); txErr != nil {
-		tx.Rollback()
-		return 0, txErr
-	}
+	return LoadFromFile(out.Name())
+}
 
-	return total, nil
+// DumpToDatabase dumps a complete server dataset into the selected database instance, creating the
+// schema via Migrator if it does not exist yet. Unlike in previous versions, the table is no longer
+// dropped and recreated on every call: DumpToDatabase is now a thin wrapper around SyncToDatabase, so
+// locally-measured columns (Probe's latency_ms, DetectCapabilities' capability flags, etc.) survive a
+// refresh and servers that disappear from 'servers' are retired rather than deleted. The returned count
+// is the number of rows inserted or updated.
+//
+// The database schema amounts to the same fields as the CSV value that you can find at public-dns.info,
+// plus the capability columns populated by DetectCapabilities. The migrations slice in sync.go lists
+// these columns; the columns written by Probe and DumpToDatabaseWithGeoLocator are added separately by
+// those functions.
+func DumpToDatabase(db *sql.DB, servers []*Nameserver) (int64, error) {
+	inserted, updated, _, err := SyncToDatabase(db, servers)
+	return inserted + updated, err
 }
 
 // PublicDNS is the structure that is used to perform queries on the nameservers dataset that was stored in a database.
@@ -253,9 +217,9 @@ type PublicDNS struct {
 // TODO Do we really need to count the amount of records?
 func (p *PublicDNS) GetAllFromCountry(country string) ([]*Nameserver, error) {
 	count := 0
-	p.DB.QueryRow("SELECT COUNT(ip) FROM nameservers as n WHERE n.country = ?", country).Scan(&count)
+	p.DB.QueryRow("SELECT COUNT(ip) FROM nameservers as n WHERE n.country = ? AND n.retired_at IS NULL", country).Scan(&count)
 
-	result, err := p.DB.Query("SELECT ip, country, city FROM nameservers as n WHERE n.country = ?", country)
+	result, err := p.DB.Query("SELECT ip, country, city FROM nameservers as n WHERE n.country = ? AND n.retired_at IS NULL", country)
 
 	if err != nil {
 		return nil, err
@@ -275,11 +239,91 @@ func (p *PublicDNS) GetAllFromCountry(country string) ([]*Nameserver, error) {
 
 }
 
-// GetBestFromCountry obtains the best DNS server from a specific country. This is measured by the reliability
-// parameter so for many countries it will always return the same server (for the US it's always Google's DNS server).
-// For countries that have less reliable DNS servers (such as those located in Africa) this could be more useful.
-func (p *PublicDNS) GetBestFromCountry(country string) (*Nameserver, error) {
-	result := p.DB.QueryRow("SELECT ip, country, city FROM nameservers WHERE country = ? ORDER BY reliability DESC LIMIT 1", country)
+// Filter narrows down the capability requirements a nameserver must satisfy. The zero value matches
+// any nameserver. Setting both IPv4 and IPv6 to false matches either address family; setting only one
+// of them restricts results to that family.
+type Filter struct {
+	// IPv4 restricts results to IPv4 addresses when true and IPv6 is false.
+	IPv4 bool
+
+	// IPv6 restricts results to IPv6 addresses when true and IPv4 is false.
+	IPv6 bool
+
+	// RequireDNSSEC restricts results to servers that report DNSSEC support.
+	RequireDNSSEC bool
+
+	// RequireDoT restricts results to servers that were observed to support DNS-over-TLS.
+	RequireDoT bool
+
+	// RequireDoH restricts results to servers that were observed to support DNS-over-HTTPS.
+	RequireDoH bool
+
+	// MinReliability, when greater than zero, restricts results to servers whose reliability is at
+	// least this value.
+	MinReliability float64
+
+	// PreferValidatedAD ranks servers whose AD bit was observed to match an independent DNSSEC
+	// validation (see Validator and PublicDNS.ScoreADCorrectness) ahead of the reliability ordering,
+	// instead of trusting the CSV-reported DNSSec flag alone. GetBestFromCountry and GetTopFromCountry
+	// order by it; GetBestFromCountries picks its row per country through a GROUP BY, which does not
+	// guarantee that the preferred server is the one returned.
+	PreferValidatedAD bool
+}
+
+// whereClause turns f into a SQL "AND ..." fragment plus its positional arguments, so that
+// GetBestFromCountry and GetBestFromCountries can compose it with the rest of their query. It returns
+// an empty string and no arguments when f is the zero value.
+func (f Filter) whereClause() (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+
+	if f.IPv4 && !f.IPv6 {
+		clauses = append(clauses, "ipv6 = 0")
+	} else if f.IPv6 && !f.IPv4 {
+		clauses = append(clauses, "ipv6 = 1")
+	}
+
+	if f.RequireDNSSEC {
+		clauses = append(clauses, "dnssec = 1")
+	}
+
+	if f.RequireDoT {
+		clauses = append(clauses, "supports_dot = 1")
+	}
+
+	if f.RequireDoH {
+		clauses = append(clauses, "supports_doh = 1")
+	}
+
+	if f.MinReliability > 0 {
+		clauses = append(clauses, "reliability >= ?")
+		args = append(args, f.MinReliability)
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+// GetBestFromCountry obtains the best DNS server from a specific country that satisfies filter. This is
+// measured by the reliability parameter so for many countries it will always return the same server
+// (for the US it's always Google's DNS server). For countries that have less reliable DNS servers
+// (such as those located in Africa) this could be more useful.
+func (p *PublicDNS) GetBestFromCountry(country string, filter Filter) (*Nameserver, error) {
+	extra, extraArgs := filter.whereClause()
+
+	order := "reliability DESC"
+	if filter.PreferValidatedAD {
+		order = "ad_correct DESC, reliability DESC"
+	}
+
+	query := "SELECT ip, country, city FROM nameservers WHERE country = ? AND retired_at IS NULL" + extra +
+		" ORDER BY " + order + " LIMIT 1"
+
+	args := append([]interface{}{country}, extraArgs...)
+	result := p.DB.QueryRow(query, args...)
 
 	info := &Nameserver{}
 	err := result.Scan(&info.IPAddress, &info.Country, &info.City)
@@ -291,16 +335,58 @@ func (p *PublicDNS) GetBestFromCountry(country string) (*Nameserver, error) {
 	return info, nil
 }
 
+// GetTopFromCountry obtains up to limit servers from country that satisfy filter, ranked the same way as
+// GetBestFromCountry. Unlike GetBestFromCountry it does not stop at the single best match, so callers
+// that need more than one candidate for a country - such as the proxy package's hedging selector - have
+// a ranked pool to pick from.
+func (p *PublicDNS) GetTopFromCountry(country string, limit int, filter Filter) ([]*Nameserver, error) {
+	extra, extraArgs := filter.whereClause()
+
+	order := "reliability DESC"
+	if filter.PreferValidatedAD {
+		order = "ad_correct DESC, reliability DESC"
+	}
+
+	query := "SELECT ip, country, city FROM nameservers WHERE country = ? AND retired_at IS NULL" + extra +
+		" ORDER BY " + order + " LIMIT ?"
+
+	args := append(append([]interface{}{country}, extraArgs...), limit)
+	rows, err := p.DB.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var dnsinfo []*Nameserver
+
+	for rows.Next() {
+		info := &Nameserver{}
+		rows.Scan(&info.IPAddress, &info.Country, &info.City)
+		dnsinfo = append(dnsinfo, info)
+	}
+
+	return dnsinfo, nil
+}
+
 // GetBestFromCountries takes a list of countries (two-letter ISO 3166-1 alpha-2 code) and obtains the best servers
-// for each of the requested countries.
-func (p *PublicDNS) GetBestFromCountries(countries []interface{}) ([]*Nameserver, error) {
+// for each of the requested countries that satisfy filter.
+func (p *PublicDNS) GetBestFromCountries(countries []interface{}, filter Filter) ([]*Nameserver, error) {
 	// This will create someting like IN(?, ?, ?) (depending on the number of countries)
 	placeholders := "?" + strings.Repeat(", ?", len(countries)-1)
+	extra, extraArgs := filter.whereClause()
+
+	order := "reliability ASC, n.checked_at ASC"
+	if filter.PreferValidatedAD {
+		order = "n.ad_correct DESC, " + order
+	}
 
 	subquery := "SELECT n.ip, n.country, n.city " +
 		"FROM nameservers AS n " +
-		"WHERE n.country IN (" + placeholders + ")  and name != '' and city != '' AND reliability = 1 " +
-		"ORDER BY reliability ASC, n.checked_at ASC"
+		"WHERE n.country IN (" + placeholders + ")  and name != '' and city != '' AND reliability = 1 AND n.retired_at IS NULL" +
+		extra + " " +
+		"ORDER BY " + order
 	query := fmt.Sprintf("SELECT * FROM (%s) as nn GROUP BY nn.country;", subquery)
 
 	stmt, err1 := p.DB.Prepare(query)
@@ -311,8 +397,9 @@ func (p *PublicDNS) GetBestFromCountries(countries []interface{}) ([]*Nameserver
 
 	defer stmt.Close()
 
-	// Then, using the variadic operator, we expand the list of countries into the placeholders
-	result, err2 := stmt.Query(countries...)
+	// Then, using the variadic operator, we expand the list of countries (and any filter arguments) into the placeholders
+	args := append(append([]interface{}{}, countries...), extraArgs...)
+	result, err2 := stmt.Query(args...)
 
 	if err2 != nil {
 		return nil, err2
@@ -336,7 +423,7 @@ func (p *PublicDNS) GetBestFromCountries(countries []interface{}) ([]*Nameserver
 func (p *PublicDNS) GetNameserverPerCountryTally() ([]*NameserverCountryTally, error) {
 	query := "SELECT n.country AS Country, COUNT(n.ip) AS Total " +
 		"FROM nameservers AS n " +
-		"WHERE n.name != '' AND n.city != '' AND n.reliability = 1 " +
+		"WHERE n.name != '' AND n.city != '' AND n.reliability = 1 AND n.retired_at IS NULL " +
 		"GROUP BY n.country"
 
 	rows, err := p.DB.Query(query)
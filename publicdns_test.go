@@ -26,6 +26,7 @@ import (
 	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -53,7 +54,11 @@ func TestLoadFailedFileLoading(t *testing.T) {
 
 // TODO Host a file somewhere to avoid using bandwidth of public-dns.info / travis-ci and also to make the test faster
 func TestLoadFromURL(t *testing.T) {
-	servers, err := LoadFromURL("https://raw.githubusercontent.com/rvelhote/go-public-dns/master/nameservers.test.csv", "nameservers.temp1.csv")
+	db, _ := sql.Open("sqlite3", "./nameservers.sync.test.db")
+	defer db.Close()
+	defer os.Remove("./nameservers.sync.test.db")
+
+	servers, err := LoadFromURL(db, "https://raw.githubusercontent.com/rvelhote/go-public-dns/master/nameservers.test.csv", "nameservers.temp1.csv")
 
 	if servers == nil || err != nil {
 		t.Error("File should have been loaded from the test URL and some servers should have been processed")
@@ -63,7 +68,7 @@ func TestLoadFromURL(t *testing.T) {
 	}
 
 	// Bad URL
-	_, err2 := LoadFromURL("http://does-not-exist-public-dns.info/nameservers.csv", "nameservers.temp2.csv")
+	_, err2 := LoadFromURL(db, "http://does-not-exist-public-dns.info/nameservers.csv", "nameservers.temp2.csv")
 	if err2 == nil {
 		t.Error("Loading from a domain that does not exist should have been an error")
 	}
@@ -117,7 +122,7 @@ func TestPublicDNS_GetBestFromCountries(t *testing.T) {
 	db, _ := loadAndConnect()
 	dns := PublicDNS{DB: db}
 
-	info, err := dns.GetBestFromCountry("DE")
+	info, err := dns.GetBestFromCountry("DE", Filter{})
 
 	if err != nil {
 		t.Errorf("GetBestFromCountry returned error -- %s --", err)
@@ -155,7 +160,7 @@ func TestPublicDNS_GetBestFromCountry(t *testing.T) {
 	db, _ := loadAndConnect()
 	dns := PublicDNS{DB: db}
 
-	info, err := dns.GetBestFromCountries([]interface{}{"US", "DE"})
+	info, err := dns.GetBestFromCountries([]interface{}{"US", "DE"}, Filter{})
 
 	if err != nil {
 		t.Errorf("GetBestFromCountries returned error -- %s --", err)
@@ -170,3 +175,26 @@ func TestPublicDNS_GetBestFromCountry(t *testing.T) {
 	}
 
 }
+
+func TestFilter_whereClause(t *testing.T) {
+	clause, args := Filter{}.whereClause()
+
+	if clause != "" || len(args) != 0 {
+		t.Errorf("The zero value Filter should produce no clause and no arguments but returned -- %q %v --", clause, args)
+	}
+
+	clause, args = Filter{IPv6: true, RequireDoH: true, MinReliability: 0.8}.whereClause()
+
+	if !strings.Contains(clause, "ipv6 = 1") || !strings.Contains(clause, "supports_doh = 1") || !strings.Contains(clause, "reliability >= ?") {
+		t.Errorf("The clause should contain all three requested conditions but returned -- %q --", clause)
+	}
+
+	if len(args) != 1 || args[0] != 0.8 {
+		t.Errorf("MinReliability should contribute its value as a positional argument but returned -- %v --", args)
+	}
+
+	clause, _ = Filter{IPv4: true, IPv6: true}.whereClause()
+	if strings.Contains(clause, "ipv6") {
+		t.Error("Setting both IPv4 and IPv6 should match either address family, i.e. no ipv6 clause at all")
+	}
+}
@@ -0,0 +1,216 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNotModified is returned by LoadFromURL when the upstream server reports, via HTTP 304, that the
+// CSV has not changed since the last successful fetch of that exact URL.
+var ErrNotModified = errors.New("publicdns: resource not modified")
+
+// migrations is the ordered list of schema statements applied by Migrator. Every statement must be
+// safe to run more than once - SQLite has no "ADD COLUMN IF NOT EXISTS", so new columns belong in the
+// CREATE TABLE below rather than in a later ALTER TABLE migration.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS nameservers (
+		ip VARCHAR(45) NOT NULL,
+		transport VARCHAR(8) NOT NULL DEFAULT 'udp',
+		name VARCHAR(64) NULL,
+		country VARCHAR(2) NULL,
+		city VARCHAR(64) NULL,
+		version VARCHAR(16) NULL,
+		error VARCHAR(256) NULL,
+		dnssec TINYINT NULL,
+		reliability FLOAT NULL,
+		checked_at DATETIME NULL,
+		created_at DATETIME NULL,
+		ipv6 TINYINT NULL,
+		supports_tcp TINYINT NULL,
+		supports_dot TINYINT NULL,
+		supports_doh TINYINT NULL,
+		edns0_size INTEGER NULL,
+		retired_at DATETIME NULL,
+		ad_correct TINYINT NULL,
+		PRIMARY KEY (ip, transport)
+	)`,
+	`CREATE INDEX IF NOT EXISTS nameservers_country_index ON nameservers(country)`,
+	`CREATE INDEX IF NOT EXISTS nameservers_country_reliability_index ON nameservers(country, reliability)`,
+	`CREATE INDEX IF NOT EXISTS nameservers_reliability_index ON nameservers(reliability)`,
+	`CREATE TABLE IF NOT EXISTS sync_metadata (
+		url VARCHAR(2048) PRIMARY KEY,
+		etag VARCHAR(256) NULL,
+		last_modified VARCHAR(64) NULL
+	)`,
+}
+
+// Migrator creates the nameservers schema and its indexes idempotently, so that refreshing the dataset
+// no longer requires DROP TABLE followed by CREATE TABLE. It keeps no schema version: every statement in
+// migrations runs on each Migrate call, and a nameservers table created with an older layout does not
+// gain the columns that were added to the CREATE TABLE statement later.
+type Migrator struct {
+	DB *sql.DB
+}
+
+// NewMigrator creates a Migrator bound to db.
+func NewMigrator(db *sql.DB) *Migrator {
+	return &Migrator{DB: db}
+}
+
+// Migrate applies every statement in migrations. Each one is idempotent, so Migrate can simply be
+// called before every operation that touches the schema instead of tracking which ones already ran.
+func (m *Migrator) Migrate() error {
+	for _, statement := range migrations {
+		if _, err := m.DB.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSyncMetadata returns the cached ETag/Last-Modified response headers for url, or two empty
+// strings if url was never fetched successfully before.
+func readSyncMetadata(db *sql.DB, url string) (etag string, lastModified string) {
+	db.QueryRow("SELECT etag, last_modified FROM sync_metadata WHERE url = ?", url).Scan(&etag, &lastModified)
+	return
+}
+
+// writeSyncMetadata persists the ETag/Last-Modified response headers observed for url so the next
+// LoadFromURL call can make a conditional request.
+func writeSyncMetadata(db *sql.DB, url string, etag string, lastModified string) {
+	db.Exec(`INSERT INTO sync_metadata(url, etag, last_modified) VALUES(?, ?, ?)
+		ON CONFLICT(url) DO UPDATE SET etag = excluded.etag, last_modified = excluded.last_modified`,
+		url, etag, lastModified)
+}
+
+// SyncToDatabase computes a diff between servers and what is already stored in the nameservers table,
+// inside a single transaction: new IPs are inserted, existing ones are updated in place (only the
+// CSV-derived columns are overwritten and retired_at is cleared; the ipv6 and capability columns are
+// written only when a row is first inserted, and locally-measured columns such as Probe's latency_ms are
+// left untouched), and any row whose IP is no longer present in servers is marked with a retired_at
+// timestamp rather than deleted. When no server in servers is stored, nothing is retired. This preserves
+// probe history across refresh cycles and enables trend analysis.
+func SyncToDatabase(db *sql.DB, servers []*Nameserver) (inserted int64, updated int64, retired int64, err error) {
+	if err = NewMigrator(db).Migrate(); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return
+	}
+
+	upsert := `INSERT INTO nameservers(ip, transport, name, country, city, version, error, dnssec,
+		reliability, checked_at, created_at, ipv6, supports_tcp, supports_dot, supports_doh, edns0_size)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(ip, transport) DO UPDATE SET
+			name = excluded.name,
+			country = excluded.country,
+			city = excluded.city,
+			version = excluded.version,
+			error = excluded.error,
+			dnssec = excluded.dnssec,
+			reliability = excluded.reliability,
+			checked_at = excluded.checked_at,
+			retired_at = NULL`
+
+	stmt, prepareErr := tx.Prepare(upsert)
+
+	if prepareErr != nil {
+		tx.Rollback()
+		err = prepareErr
+		return
+	}
+
+	present := make([]string, 0, len(servers))
+
+	for _, server := range servers {
+		transport := server.Transport
+		if transport == "" {
+			transport = "udp"
+		}
+
+		existing := existingRowCount(tx, server.IPAddress, transport)
+
+		_, execErr := stmt.Exec(
+			server.IPAddress, transport, server.Name, server.Country, server.City, server.Version,
+			server.Error, server.DNSSec, server.Reliability, server.CheckedAt, server.CreatedAt,
+			server.IPv6, server.SupportsTCP, server.SupportsDoT, server.SupportsDoH, server.EDNS0Size,
+		)
+
+		if execErr != nil {
+			continue
+		}
+
+		if existing == 0 {
+			inserted++
+		} else {
+			updated++
+		}
+
+		present = append(present, server.IPAddress)
+	}
+
+	stmt.Close()
+
+	if len(present) > 0 {
+		placeholders := "?" + strings.Repeat(", ?", len(present)-1)
+
+		args := make([]interface{}, 0, len(present)+1)
+		args = append(args, time.Now())
+		for _, ip := range present {
+			args = append(args, ip)
+		}
+
+		result, retireErr := tx.Exec(
+			"UPDATE nameservers SET retired_at = ? WHERE ip NOT IN ("+placeholders+") AND retired_at IS NULL",
+			args...,
+		)
+
+		if retireErr == nil {
+			retired, _ = result.RowsAffected()
+		}
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		tx.Rollback()
+		err = commitErr
+		return
+	}
+
+	return
+}
+
+// existingRowCount reports how many non-retired rows already exist for (ip, transport), used to tell
+// an insert from an update while computing SyncToDatabase's diff.
+func existingRowCount(tx *sql.Tx, ip string, transport string) int {
+	var count int
+	tx.QueryRow("SELECT COUNT(*) FROM nameservers WHERE ip = ? AND transport = ? AND retired_at IS NULL", ip, transport).Scan(&count)
+	return count
+}
@@ -0,0 +1,73 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"testing"
+)
+
+func TestSyncToDatabase(t *testing.T) {
+	db, _ := sql.Open("sqlite3", "./nameservers.sync.diff.test.db")
+	defer db.Close()
+	defer os.Remove("./nameservers.sync.diff.test.db")
+
+	first := []*Nameserver{
+		{IPAddress: "1.1.1.1", Country: "US"},
+		{IPAddress: "2.2.2.2", Country: "DE"},
+	}
+
+	inserted, updated, retired, err := SyncToDatabase(db, first)
+
+	if err != nil {
+		t.Fatalf("First sync should not have returned an error -- %s --", err)
+	}
+
+	if inserted != 2 || updated != 0 || retired != 0 {
+		t.Errorf("First sync should insert both servers but got inserted=%d updated=%d retired=%d", inserted, updated, retired)
+	}
+
+	second := []*Nameserver{
+		{IPAddress: "1.1.1.1", Country: "US"},
+		{IPAddress: "3.3.3.3", Country: "FR"},
+	}
+
+	inserted, updated, retired, err = SyncToDatabase(db, second)
+
+	if err != nil {
+		t.Fatalf("Second sync should not have returned an error -- %s --", err)
+	}
+
+	if inserted != 1 || updated != 1 || retired != 1 {
+		t.Errorf("Second sync should insert 3.3.3.3, update 1.1.1.1 and retire 2.2.2.2 but got inserted=%d updated=%d retired=%d", inserted, updated, retired)
+	}
+
+	var retiredAt sql.NullString
+	db.QueryRow("SELECT retired_at FROM nameservers WHERE ip = ?", "2.2.2.2").Scan(&retiredAt)
+
+	if !retiredAt.Valid {
+		t.Error("2.2.2.2 dropped out of the feed so it should have been marked retired_at instead of being deleted")
+	}
+}
@@ -0,0 +1,554 @@
+// Package publicdns allows the user to obtain data from public-dns.info, query and manage the data
+package publicdns
+
+/*
+ * The MIT License (MIT)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootTrustAnchor is the IANA root zone KSK-2017 DS record (key tag 20326), bundled with the module so
+// that Validator can establish a chain of trust without fetching the anchor externally. See
+// https://www.iana.org/dnssec/files for the authoritative copy.
+const rootTrustAnchor = ". 0 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// ValidationState describes the outcome of a DNSSEC validation, as defined by RFC 4035 section 4.3.
+type ValidationState int
+
+const (
+	// Indeterminate means the validator could not tell whether the zone is signed, e.g. because a
+	// DNSKEY or RRSIG record could not be fetched.
+	Indeterminate ValidationState = iota
+
+	// Insecure means the zone was determined not to be signed.
+	Insecure
+
+	// Secure means a complete chain of trust from the bundled root anchor down to the answer was
+	// verified.
+	Secure
+
+	// Bogus means a signature failed to verify, a DS digest didn't match, or denial-of-existence
+	// proof was missing or invalid.
+	Bogus
+)
+
+// String renders the ValidationState using the lowercase RFC 4035 terminology.
+func (s ValidationState) String() string {
+	switch s {
+	case Secure:
+		return "secure"
+	case Insecure:
+		return "insecure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "indeterminate"
+	}
+}
+
+// Answer is the resolved answer returned by Validator.Validate / PublicDNS.ValidatingResolve.
+type Answer struct {
+	// Records is the answer section of the response.
+	Records []dns.RR
+
+	// Rcode is the response code the upstream returned, e.g. dns.RcodeSuccess or dns.RcodeNameError.
+	Rcode int
+}
+
+// Validator wraps a single upstream nameserver and performs DNSSEC chain validation on top of it: it
+// walks the delegation path from the bundled root trust anchor down to the queried name, fetching
+// DNSKEY/DS records and verifying RRSIG signatures at every zone cut, then either verifies the signature
+// over the answer or, when there is no answer, verifies the NSEC/NSEC3 denial-of-existence proof carried
+// in the authority section.
+//
+// Every record involved is fetched through Upstream rather than iteratively from the authoritative
+// servers, the same way a validating stub resolver layered on top of a plain forwarder works.
+type Validator struct {
+	Upstream string
+	Client   *dns.Client
+}
+
+// NewValidator creates a Validator that performs every lookup through upstream (a "host:port" pair).
+func NewValidator(upstream string) *Validator {
+	return &Validator{Upstream: upstream, Client: &dns.Client{Net: "udp", Timeout: 2 * time.Second}}
+}
+
+// Validate resolves qname/qtype through the Validator's upstream and independently verifies the
+// DNSSEC chain of trust for the answer - or, when the answer section is empty, for the NSEC/NSEC3
+// denial-of-existence proof carried in the authority section, so that an NXDOMAIN/NODATA response can be
+// proven Secure or Bogus rather than trusted outright.
+func (v *Validator) Validate(ctx context.Context, qname string, qtype uint16) (*Answer, ValidationState, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(qname), qtype)
+	msg.SetEdns0(4096, true)
+
+	resp, _, err := v.Client.ExchangeContext(ctx, msg, v.Upstream)
+
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+
+	answer := &Answer{Records: resp.Answer, Rcode: resp.Rcode}
+
+	if len(resp.Answer) == 0 {
+		state, err := v.validateDenial(ctx, resp, dns.Fqdn(qname), qtype)
+		return answer, state, err
+	}
+
+	state, err := v.validateChain(ctx, dns.Fqdn(qname), resp.Answer)
+
+	return answer, state, err
+}
+
+// validateChain walks the delegation path for qname one label at a time, starting at the root, pinning
+// trust at each zone cut to the DS records served by the parent (fetched through Upstream, which is
+// assumed to answer authoritatively or recursively for both zones), then verifies the answer's RRSIG
+// against qname's own DNSKEY set.
+func (v *Validator) validateChain(ctx context.Context, qname string, answerRRset []dns.RR) (ValidationState, error) {
+	dnskeySet, state, err := v.validateZoneChain(ctx, qname)
+
+	if state != Secure {
+		return state, err
+	}
+
+	if err := verifyRRset(answerRRset, dnskeySet); err != nil {
+		return Bogus, err
+	}
+
+	return Secure, nil
+}
+
+// validateZoneChain walks the delegation path from the root down to zone one label at a time, pinning
+// trust at each cut to the DS records served by the parent, and returns zone's own verified DNSKEY set.
+// It underlies both validateChain (verifying an answer at qname) and validateDenial (verifying the
+// NSEC/NSEC3 records served by the zone that owns the denial proof, which need not be qname itself).
+func (v *Validator) validateZoneChain(ctx context.Context, zone string) ([]dns.RR, ValidationState, error) {
+	trustedDS, err := parseTrustAnchor()
+
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+
+	zone = dns.Fqdn(zone)
+	labels := dns.SplitDomainName(zone)
+
+	for depth := len(labels); depth >= 0; depth-- {
+		cut := "."
+		if depth < len(labels) {
+			cut = dns.Fqdn(strings.Join(labels[depth:], "."))
+		}
+
+		dnskeySet, dnskeyRRSIG, err := v.queryWithRRSIG(ctx, cut, dns.TypeDNSKEY)
+
+		if err != nil {
+			return nil, Indeterminate, err
+		}
+
+		if len(dnskeySet) == 0 {
+			return nil, Insecure, nil
+		}
+
+		ksk, err := verifyDNSKEYSet(dnskeySet, dnskeyRRSIG, trustedDS)
+
+		if err != nil {
+			return nil, Bogus, err
+		}
+
+		if cut == zone {
+			return dnskeySet, Secure, nil
+		}
+
+		child := childZone(cut, labels, depth)
+		trustedDS, err = v.queryDS(ctx, child, ksk)
+
+		if err != nil {
+			return nil, Insecure, nil
+		}
+	}
+
+	return nil, Indeterminate, nil
+}
+
+// validateDenial proves, using the NSEC/NSEC3 records in resp's authority section, that qname/qtype
+// legitimately has no answer - either because qname doesn't exist or because it exists but owns no
+// record of qtype - rather than trusting an empty answer section outright, which a man-in-the-middle
+// could forge by stripping records from an otherwise signed response.
+func (v *Validator) validateDenial(ctx context.Context, resp *dns.Msg, qname string, qtype uint16) (ValidationState, error) {
+	var soa *dns.SOA
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	var sigs []*dns.RRSIG
+
+	for _, rr := range resp.Ns {
+		switch r := rr.(type) {
+		case *dns.SOA:
+			soa = r
+		case *dns.NSEC:
+			nsecs = append(nsecs, r)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, r)
+		case *dns.RRSIG:
+			sigs = append(sigs, r)
+		}
+	}
+
+	if soa == nil {
+		return Insecure, nil
+	}
+
+	dnskeySet, state, err := v.validateZoneChain(ctx, soa.Hdr.Name)
+
+	if state != Secure {
+		return state, err
+	}
+
+	verifiedOwner := func(owner string, typeCovered uint16, rr dns.RR) bool {
+		for _, sig := range sigs {
+			if sig.TypeCovered != typeCovered || !strings.EqualFold(sig.Header().Name, owner) {
+				continue
+			}
+
+			for _, keyRR := range dnskeySet {
+				if key, ok := keyRR.(*dns.DNSKEY); ok && sig.Verify(key, []dns.RR{rr}) == nil {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	if len(nsecs) > 0 {
+		for _, n := range nsecs {
+			if !verifiedOwner(n.Hdr.Name, dns.TypeNSEC, n) {
+				continue
+			}
+
+			if strings.EqualFold(dns.Fqdn(n.Hdr.Name), qname) {
+				return denialStateForTypeBitMap(n.TypeBitMap, qtype), nil
+			}
+
+			if nsecCovers(n, qname) {
+				return Secure, nil
+			}
+		}
+
+		return Bogus, errors.New("publicdns: no verified NSEC record denies " + qname)
+	}
+
+	if len(nsec3s) > 0 {
+		for _, n := range nsec3s {
+			if !verifiedOwner(n.Hdr.Name, dns.TypeNSEC3, n) {
+				continue
+			}
+
+			if n.Match(qname) {
+				return denialStateForTypeBitMap(n.TypeBitMap, qtype), nil
+			}
+
+			if n.Cover(qname) {
+				// This only checks that some NSEC3 in the authority section covers qname, not the full
+				// three-record (closest encloser + next-closer + wildcard) NXDOMAIN proof RFC 5155
+				// describes; it's enough to catch a forged empty answer but not to audit a borderline
+				// wildcard-expansion proof.
+				if n.Flags&1 != 0 {
+					// The Opt-Out flag only proves qname falls in an unsigned delegation's span, which
+					// is as far as denial can go without that child zone's own chain of trust.
+					return Insecure, nil
+				}
+
+				return Secure, nil
+			}
+		}
+
+		return Bogus, errors.New("publicdns: no verified NSEC3 record denies " + qname)
+	}
+
+	return Bogus, errors.New("publicdns: no NSEC or NSEC3 record proves the denial of " + qname)
+}
+
+// denialStateForTypeBitMap reports whether an NSEC/NSEC3 record matched at the queried name proves
+// NODATA (Secure, qtype absent from typeBitMap) or contradicts the empty answer section (Bogus, qtype
+// present - the server should have returned it).
+func denialStateForTypeBitMap(typeBitMap []uint16, qtype uint16) ValidationState {
+	for _, t := range typeBitMap {
+		if t == qtype {
+			return Bogus
+		}
+	}
+
+	return Secure
+}
+
+// canonicalLess reports whether a sorts strictly before b under the canonical DNS name ordering that
+// RFC 4034 section 6.1 defines (compare labels right-to-left, case-insensitively), which is what NSEC's
+// "owner < name < next" covering proof relies on.
+func canonicalLess(a, b string) bool {
+	al := dns.SplitDomainName(dns.Fqdn(a))
+	bl := dns.SplitDomainName(dns.Fqdn(b))
+
+	for i := 1; i <= len(al) && i <= len(bl); i++ {
+		la := strings.ToLower(al[len(al)-i])
+		lb := strings.ToLower(bl[len(bl)-i])
+
+		if la != lb {
+			return la < lb
+		}
+	}
+
+	return len(al) < len(bl)
+}
+
+// nsecCovers reports whether rr's owner/NextDomain span proves that name does not exist, including the
+// wraparound case where rr is the last NSEC record in the zone (whose NextDomain is the zone apex rather
+// than something canonically after the owner name).
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	owner, next, name := dns.Fqdn(rr.Hdr.Name), dns.Fqdn(rr.NextDomain), dns.Fqdn(name)
+
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+// childZone returns the next zone down the delegation path from zone towards the original qname.
+func childZone(zone string, labels []string, depth int) string {
+	if depth == 0 {
+		return dns.Fqdn(strings.Join(labels, "."))
+	}
+
+	return dns.Fqdn(strings.Join(labels[depth-1:], "."))
+}
+
+// queryWithRRSIG fetches rrtype for zone along with its covering RRSIG record.
+func (v *Validator) queryWithRRSIG(ctx context.Context, zone string, rrtype uint16) ([]dns.RR, *dns.RRSIG, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(zone, rrtype)
+	msg.SetEdns0(4096, true)
+
+	resp, _, err := v.Client.ExchangeContext(ctx, msg, v.Upstream)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rrset []dns.RR
+	var rrsig *dns.RRSIG
+
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrsig = sig
+			continue
+		}
+
+		rrset = append(rrset, rr)
+	}
+
+	return rrset, rrsig, nil
+}
+
+// queryDS fetches the DS RRset for zone along with its covering RRSIG and verifies that signature
+// against ksk (the parent zone's already-validated DNSKEY) before returning it, so a spoofing upstream
+// can't hand validateZoneChain an attacker-controlled DS for the next zone down.
+func (v *Validator) queryDS(ctx context.Context, zone string, ksk *dns.DNSKEY) ([]dns.RR, error) {
+	dsSet, dsRRSIG, err := v.queryWithRRSIG(ctx, zone, dns.TypeDS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dsSet) == 0 {
+		return nil, errors.New("publicdns: no DS records found for " + zone)
+	}
+
+	if dsRRSIG == nil {
+		return nil, errors.New("publicdns: DS RRset is missing its RRSIG")
+	}
+
+	if err := dsRRSIG.Verify(ksk, dsSet); err != nil {
+		return nil, err
+	}
+
+	return dsSet, nil
+}
+
+// verifyDNSKEYSet verifies that dnskeyRRSIG covers dnskeySet with a key-signing key from dnskeySet, and
+// that that KSK's DS digest is present in trustedDS. It returns the verified KSK so the caller can use
+// it to validate the next zone's DS record.
+func verifyDNSKEYSet(dnskeySet []dns.RR, dnskeyRRSIG *dns.RRSIG, trustedDS []dns.RR) (*dns.DNSKEY, error) {
+	if dnskeyRRSIG == nil {
+		return nil, errors.New("publicdns: DNSKEY RRset is missing its RRSIG")
+	}
+
+	for _, rr := range dnskeySet {
+		key, ok := rr.(*dns.DNSKEY)
+
+		if !ok || key.Flags&dns.SEP == 0 {
+			continue
+		}
+
+		for _, dsRR := range trustedDS {
+			ds, ok := dsRR.(*dns.DS)
+
+			if !ok {
+				continue
+			}
+
+			candidate := key.ToDS(ds.DigestType)
+
+			if candidate == nil || !strings.EqualFold(candidate.Digest, ds.Digest) {
+				continue
+			}
+
+			if err := dnskeyRRSIG.Verify(key, dnskeySet); err != nil {
+				return nil, err
+			}
+
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("publicdns: no DNSKEY matched a trusted DS record")
+}
+
+// verifyRRset verifies that one of the RRSIGs covering answerRRset validates against a zone-signing
+// key present in dnskeySet.
+func verifyRRset(answerRRset []dns.RR, dnskeySet []dns.RR) error {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+
+	for _, rr := range answerRRset {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		rrset = append(rrset, rr)
+	}
+
+	if len(sigs) == 0 {
+		return errors.New("publicdns: answer is missing its RRSIG")
+	}
+
+	for _, sig := range sigs {
+		for _, rr := range dnskeySet {
+			key, ok := rr.(*dns.DNSKEY)
+
+			if !ok {
+				continue
+			}
+
+			if sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("publicdns: no DNSKEY validated the answer's RRSIG")
+}
+
+// parseTrustAnchor parses the bundled root trust anchor into a DS record.
+func parseTrustAnchor() ([]dns.RR, error) {
+	rr, err := dns.NewRR(rootTrustAnchor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []dns.RR{rr}, nil
+}
+
+// ValidatingResolve resolves qname/qtype through a Validator built on top of the given upstream,
+// returning both the answer and the independently-verified ValidationState. It's a natural extension of
+// the DNSSec field on Nameserver, which until now only ever recorded the CSV-reported capability
+// without ever being exercised against a live query.
+func (p *PublicDNS) ValidatingResolve(ctx context.Context, upstream string, qname string, qtype uint16) (*Answer, ValidationState, error) {
+	return NewValidator(upstream).Validate(ctx, qname, qtype)
+}
+
+// ensureValidationColumns adds the ad_correct column used to rank GetBestFromCountry by observed AD-bit
+// correctness, if it is not already present.
+func ensureValidationColumns(db *sql.DB) error {
+	db.Exec(`ALTER TABLE nameservers ADD COLUMN ad_correct TINYINT NULL`)
+	return nil
+}
+
+// ScoreADCorrectness queries every non-retired nameserver for qname/qtype and compares the AD bit it
+// returned against an independent Validator run through that same server, recording whether the two
+// agreed into the ad_correct column. Filter.PreferValidatedAD then lets GetBestFromCountry prefer
+// servers whose AD bit can actually be trusted over ones that merely claim DNSSEC support in the CSV.
+func (p *PublicDNS) ScoreADCorrectness(ctx context.Context, qname string, qtype uint16) error {
+	if err := ensureValidationColumns(p.DB); err != nil {
+		return err
+	}
+
+	rows, err := p.DB.Query("SELECT ip FROM nameservers WHERE retired_at IS NULL")
+
+	if err != nil {
+		return err
+	}
+
+	var ips []string
+	for rows.Next() {
+		var ip string
+		rows.Scan(&ip)
+		ips = append(ips, ip)
+	}
+	rows.Close()
+
+	stmt, err := p.DB.Prepare("UPDATE nameservers SET ad_correct = ? WHERE ip = ?")
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	for _, ip := range ips {
+		upstream := dnsAddr(ip)
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(qname), qtype)
+		msg.SetEdns0(4096, true)
+
+		client := dns.Client{Net: "udp", Timeout: 2 * time.Second}
+		resp, _, err := client.ExchangeContext(ctx, msg, upstream)
+
+		if err != nil {
+			continue
+		}
+
+		_, state, _ := NewValidator(upstream).Validate(ctx, qname, qtype)
+
+		correct := resp.AuthenticatedData == (state == Secure)
+		stmt.Exec(correct, ip)
+	}
+
+	return nil
+}